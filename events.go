@@ -6,6 +6,7 @@ package backend
 
 import (
 	"strings"
+	"sync"
 
 	"github.com/limetext/backend/log"
 	"github.com/limetext/util"
@@ -14,8 +15,20 @@ import (
 type (
 	// An event callback dealing with View events.
 	ViewEventCallback func(v *View)
-	// A ViewEvent is simply a bunch of ViewEventCallbacks.
-	ViewEvent []ViewEventCallback
+	// A ViewEvent holds the ViewEventCallbacks registered against it.
+	//
+	// Callbacks added via Add run synchronously, inline with Call, in
+	// registration order. Callbacks added via AddAsync run on their own
+	// goroutine and are handed the View only after the synchronous
+	// callbacks have all finished.
+	ViewEvent struct {
+		mu         sync.RWMutex
+		nextID     uint64
+		order      []uint64
+		callbacks  map[uint64]ViewEventCallback
+		async      map[uint64]*asyncSub
+		middleware []ViewEventMiddleware
+	}
 
 	// The return value returned from a QueryContextCallback.
 	QueryContextReturn int
@@ -35,13 +48,35 @@ type (
 	// describe the key binding context to be able to discern which action is appropriate when 'j' is then pressed.
 	QueryContextCallback func(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn
 
-	// A QueryContextEvent is simply a bunch of QueryContextCallbacks.
-	QueryContextEvent []QueryContextCallback
+	// A QueryContextEvent holds the QueryContextCallbacks registered against it.
+	//
+	// In addition to the ordered callback list used for the general case,
+	// it keeps a keyed registry (see RegisterKey and RegisterPrefix) so that
+	// the common case of "a handler only cares about one context key" can be
+	// dispatched in O(1) instead of scanning every registered callback.
+	QueryContextEvent struct {
+		mu        sync.RWMutex
+		nextID    uint64
+		order     []uint64
+		callbacks map[uint64]QueryContextCallback
+
+		keyed       map[string]QueryContextCallback
+		prefixed    map[string]QueryContextCallback
+		prefixOrder []string // prefixed's keys, sorted longest-first
+
+		middleware []QueryContextMiddleware
+	}
 
 	// A WindowEventCallback deals with Window events.
 	WindowEventCallback func(w *Window)
-	// A WindowEvent is simply a bunch of WindowEventCallbacks.
-	WindowEvent []WindowEventCallback
+	// A WindowEvent holds the WindowEventCallbacks registered against it.
+	WindowEvent struct {
+		mu         sync.RWMutex
+		nextID     uint64
+		order      []uint64
+		callbacks  map[uint64]WindowEventCallback
+		middleware []WindowEventMiddleware
+	}
 
 	// The InitCallback allows complex (i.e. time consuming)
 	// initiation code to be deferred until after the UI is up and running.
@@ -50,17 +85,34 @@ type (
 	// The InitEvent is executed once at startup, after the UI is up and running and
 	// is typically used by feature modules to defer heavy initialization work
 	// such as scanning for plugins, loading key bindings, macros etc.
-	InitEvent []InitCallback
+	InitEvent struct {
+		mu        sync.RWMutex
+		nextID    uint64
+		order     []uint64
+		callbacks map[uint64]InitCallback
+	}
 
 	// Dealing with package events
 	PathEventCallback func(name string)
 
-	// A PathEvent is simply a bunch of PathEventCallbacks.
-	PathEvent []PathEventCallback
+	// A PathEvent holds the PathEventCallbacks registered against it.
+	PathEvent struct {
+		mu         sync.RWMutex
+		nextID     uint64
+		order      []uint64
+		callbacks  map[uint64]PathEventCallback
+		middleware []PathEventMiddleware
+	}
 
 	ProjectEventCallback func(w *Window, name string)
 
-	ProjectEvent []ProjectEventCallback
+	ProjectEvent struct {
+		mu         sync.RWMutex
+		nextID     uint64
+		order      []uint64
+		callbacks  map[uint64]ProjectEventCallback
+		middleware []ProjectEventMiddleware
+	}
 )
 
 const (
@@ -69,49 +121,197 @@ const (
 	Unknown                           //< Returned when the QueryContextCallback does not know how to deal with the given context.
 )
 
+// A Subscription is the handle returned by an Event's Add method. Cancel
+// removes the associated callback; it is safe to call more than once and
+// safe to call concurrently with the event firing.
+type Subscription struct {
+	id     uint64
+	remove func(id uint64)
+}
+
+// Cancel removes the callback this Subscription was created for. Calling
+// Cancel on a nil Subscription, or more than once, is a no-op.
+func (s *Subscription) Cancel() {
+	if s == nil || s.remove == nil {
+		return
+	}
+	s.remove(s.id)
+	s.remove = nil
+}
+
 // Add the InitCallback to the InitEvent to be called during initialization.
 // This should be called in a module's init() function.
-func (ie *InitEvent) Add(i InitCallback) {
-	*ie = append(*ie, i)
+func (ie *InitEvent) Add(i InitCallback) *Subscription {
+	ie.mu.Lock()
+	defer ie.mu.Unlock()
+	if ie.callbacks == nil {
+		ie.callbacks = make(map[uint64]InitCallback)
+	}
+	ie.nextID++
+	id := ie.nextID
+	ie.callbacks[id] = i
+	ie.order = append(ie.order, id)
+	return &Subscription{id: id, remove: ie.remove}
+}
+
+func (ie *InitEvent) remove(id uint64) {
+	ie.mu.Lock()
+	defer ie.mu.Unlock()
+	if _, ok := ie.callbacks[id]; !ok {
+		return
+	}
+	delete(ie.callbacks, id)
+	for i, oid := range ie.order {
+		if oid == id {
+			ie.order = append(ie.order[:i], ie.order[i+1:]...)
+			break
+		}
+	}
 }
 
 // Execute the InitEvent.
 func (ie *InitEvent) call() {
 	log.Debug("OnInit callbacks executing")
 	defer log.Debug("OnInit callbacks finished")
-	for _, ev := range *ie {
-		ev()
+	ie.mu.RLock()
+	cbs := make([]InitCallback, 0, len(ie.order))
+	for _, id := range ie.order {
+		cbs = append(cbs, ie.callbacks[id])
+	}
+	ie.mu.RUnlock()
+	for _, ev := range cbs {
+		recoverAndLog("OnInit", ev)
 	}
 }
 
-// Add the provided ViewEventCallback to this ViewEvent
-// TODO(.): Support removing ViewEventCallbacks?
-func (ve *ViewEvent) Add(cb ViewEventCallback) {
-	*ve = append(*ve, cb)
+// Add the provided ViewEventCallback to this ViewEvent. The returned
+// Subscription's Cancel method removes the callback again.
+func (ve *ViewEvent) Add(cb ViewEventCallback) *Subscription {
+	ve.mu.Lock()
+	defer ve.mu.Unlock()
+	if ve.callbacks == nil {
+		ve.callbacks = make(map[uint64]ViewEventCallback)
+	}
+	ve.nextID++
+	id := ve.nextID
+	ve.callbacks[id] = cb
+	ve.order = append(ve.order, id)
+	return &Subscription{id: id, remove: ve.remove}
+}
+
+func (ve *ViewEvent) remove(id uint64) {
+	ve.mu.Lock()
+	defer ve.mu.Unlock()
+	if _, ok := ve.callbacks[id]; !ok {
+		return
+	}
+	delete(ve.callbacks, id)
+	for i, oid := range ve.order {
+		if oid == id {
+			ve.order = append(ve.order[:i], ve.order[i+1:]...)
+			break
+		}
+	}
 }
 
 // Trigger this ViewEvent by calling all the registered callbacks in order of registration.
+// Synchronous callbacks (Add) run inline, in registration order; then v is
+// handed off to every async callback (AddAsync) without waiting for them to
+// run; the hand-off itself blocks while an async callback's queue is full
+// (see AsyncOpts.Queue).
 // TODO: should calling be exported?
 func (ve *ViewEvent) Call(v *View) {
-	log.Finest("%s(%v)", evNames[ve], v.Id())
-	for _, ev := range *ve {
-		ev(v)
+	ve.mu.RLock()
+	cbs := make([]ViewEventCallback, 0, len(ve.order))
+	for _, id := range ve.order {
+		cbs = append(cbs, ve.callbacks[id])
+	}
+	asyncSubs := make([]*asyncSub, 0, len(ve.async))
+	for _, as := range ve.async {
+		asyncSubs = append(asyncSubs, as)
+	}
+	mws := make([]ViewEventMiddleware, len(ve.middleware))
+	copy(mws, ve.middleware)
+	ve.mu.RUnlock()
+
+	name := evNames[ve]
+	log.Finest("%s(%v)", name, v.Id())
+	for _, ev := range cbs {
+		ve.dispatch(name, mws, ev, v)
+	}
+	for _, as := range asyncSubs {
+		as.deliver(v)
 	}
 }
 
-// Add the provided QueryContextCallback to the QueryContextEvent.
-// TODO(.): Support removing QueryContextCallbacks?
-func (qe *QueryContextEvent) Add(cb QueryContextCallback) {
-	*qe = append(*qe, cb)
+// Add the provided QueryContextCallback to the QueryContextEvent. The
+// returned Subscription's Cancel method removes the callback again.
+func (qe *QueryContextEvent) Add(cb QueryContextCallback) *Subscription {
+	qe.mu.Lock()
+	defer qe.mu.Unlock()
+	if qe.callbacks == nil {
+		qe.callbacks = make(map[uint64]QueryContextCallback)
+	}
+	qe.nextID++
+	id := qe.nextID
+	qe.callbacks[id] = cb
+	qe.order = append(qe.order, id)
+	return &Subscription{id: id, remove: qe.remove}
+}
+
+func (qe *QueryContextEvent) remove(id uint64) {
+	qe.mu.Lock()
+	defer qe.mu.Unlock()
+	if _, ok := qe.callbacks[id]; !ok {
+		return
+	}
+	delete(qe.callbacks, id)
+	for i, oid := range qe.order {
+		if oid == id {
+			qe.order = append(qe.order[:i], qe.order[i+1:]...)
+			break
+		}
+	}
 }
 
 // Searches for a QueryContextCallback and returns the result of the first callback being able to deal with this
 // context, or Unknown if no such callback was found.
+//
+// Dispatch first tries an exact RegisterKey match, then walks RegisterPrefix
+// matches longest-first, and only falls back to scanning the general,
+// registration-ordered callback list (Add) if neither produced an answer.
 // TODO: should calling be exported?
-func (qe QueryContextEvent) Call(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+func (qe *QueryContextEvent) Call(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+	qe.mu.RLock()
+	keyedCb := qe.keyed[key]
+	var prefixCbs []QueryContextCallback
+	for _, p := range qe.prefixOrder {
+		if strings.HasPrefix(key, p) {
+			prefixCbs = append(prefixCbs, qe.prefixed[p])
+		}
+	}
+	cbs := make([]QueryContextCallback, 0, len(qe.order))
+	for _, id := range qe.order {
+		cbs = append(cbs, qe.callbacks[id])
+	}
+	mws := make([]QueryContextMiddleware, len(qe.middleware))
+	copy(mws, qe.middleware)
+	qe.mu.RUnlock()
+
 	log.Fine("Query context: %s, %v, %v, %v", key, operator, operand, match_all)
-	for i := range qe {
-		r := qe[i](v, key, operator, operand, match_all)
+
+	if keyedCb != nil {
+		if r := qe.dispatch("OnQueryContext", mws, keyedCb, v, key, operator, operand, match_all); r != Unknown {
+			return r
+		}
+	}
+	for _, ev := range prefixCbs {
+		if r := qe.dispatch("OnQueryContext", mws, ev, v, key, operator, operand, match_all); r != Unknown {
+			return r
+		}
+	}
+	for _, ev := range cbs {
+		r := qe.dispatch("OnQueryContext", mws, ev, v, key, operator, operand, match_all)
 		if r != Unknown {
 			return r
 		}
@@ -120,40 +320,142 @@ func (qe QueryContextEvent) Call(v *View, key string, operator util.Op, operand
 	return Unknown
 }
 
-// Add the provided WindowEventCallback to this WindowEvent.
-// TODO(.): Support removing WindowEventCallbacks?
-func (we *WindowEvent) Add(cb WindowEventCallback) {
-	*we = append(*we, cb)
+// Add the provided WindowEventCallback to this WindowEvent. The returned
+// Subscription's Cancel method removes the callback again.
+func (we *WindowEvent) Add(cb WindowEventCallback) *Subscription {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	if we.callbacks == nil {
+		we.callbacks = make(map[uint64]WindowEventCallback)
+	}
+	we.nextID++
+	id := we.nextID
+	we.callbacks[id] = cb
+	we.order = append(we.order, id)
+	return &Subscription{id: id, remove: we.remove}
+}
+
+func (we *WindowEvent) remove(id uint64) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	if _, ok := we.callbacks[id]; !ok {
+		return
+	}
+	delete(we.callbacks, id)
+	for i, oid := range we.order {
+		if oid == id {
+			we.order = append(we.order[:i], we.order[i+1:]...)
+			break
+		}
+	}
 }
 
 // Trigger this WindowEvent by calling all the registered callbacks in order of registration.
 // TODO: should calling be exported?
 func (we *WindowEvent) Call(w *Window) {
-	log.Finest("%s(%v)", wevNames[we], w.Id())
-	for _, ev := range *we {
-		ev(w)
+	we.mu.RLock()
+	cbs := make([]WindowEventCallback, 0, len(we.order))
+	for _, id := range we.order {
+		cbs = append(cbs, we.callbacks[id])
+	}
+	mws := make([]WindowEventMiddleware, len(we.middleware))
+	copy(mws, we.middleware)
+	we.mu.RUnlock()
+
+	name := wevNames[we]
+	log.Finest("%s(%v)", name, w.Id())
+	for _, ev := range cbs {
+		we.dispatch(name, mws, ev, w)
 	}
 }
 
-func (pe *PathEvent) Add(cb PathEventCallback) {
-	*pe = append(*pe, cb)
+func (pe *PathEvent) Add(cb PathEventCallback) *Subscription {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if pe.callbacks == nil {
+		pe.callbacks = make(map[uint64]PathEventCallback)
+	}
+	pe.nextID++
+	id := pe.nextID
+	pe.callbacks[id] = cb
+	pe.order = append(pe.order, id)
+	return &Subscription{id: id, remove: pe.remove}
+}
+
+func (pe *PathEvent) remove(id uint64) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if _, ok := pe.callbacks[id]; !ok {
+		return
+	}
+	delete(pe.callbacks, id)
+	for i, oid := range pe.order {
+		if oid == id {
+			pe.order = append(pe.order[:i], pe.order[i+1:]...)
+			break
+		}
+	}
 }
 
 func (pe *PathEvent) call(p string) {
-	log.Finest("%s(%v)", pkgPathevNames[pe], p)
-	for _, ev := range *pe {
-		ev(p)
+	pe.mu.RLock()
+	cbs := make([]PathEventCallback, 0, len(pe.order))
+	for _, id := range pe.order {
+		cbs = append(cbs, pe.callbacks[id])
+	}
+	mws := make([]PathEventMiddleware, len(pe.middleware))
+	copy(mws, pe.middleware)
+	pe.mu.RUnlock()
+
+	name := pkgPathevNames[pe]
+	log.Finest("%s(%v)", name, p)
+	for _, ev := range cbs {
+		pe.dispatch(name, mws, ev, p)
+	}
+}
+
+func (pe *ProjectEvent) Add(cb ProjectEventCallback) *Subscription {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if pe.callbacks == nil {
+		pe.callbacks = make(map[uint64]ProjectEventCallback)
 	}
+	pe.nextID++
+	id := pe.nextID
+	pe.callbacks[id] = cb
+	pe.order = append(pe.order, id)
+	return &Subscription{id: id, remove: pe.remove}
 }
 
-func (pe *ProjectEvent) Add(cb ProjectEventCallback) {
-	*pe = append(*pe, cb)
+func (pe *ProjectEvent) remove(id uint64) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if _, ok := pe.callbacks[id]; !ok {
+		return
+	}
+	delete(pe.callbacks, id)
+	for i, oid := range pe.order {
+		if oid == id {
+			pe.order = append(pe.order[:i], pe.order[i+1:]...)
+			break
+		}
+	}
 }
 
 func (pe *ProjectEvent) call(w *Window, p string) {
-	log.Finest("%s(%v, %s)", projectevNames[pe], w, p)
-	for _, ev := range *pe {
-		ev(w, p)
+	pe.mu.RLock()
+	cbs := make([]ProjectEventCallback, 0, len(pe.order))
+	for _, id := range pe.order {
+		cbs = append(cbs, pe.callbacks[id])
+	}
+	mws := make([]ProjectEventMiddleware, len(pe.middleware))
+	copy(mws, pe.middleware)
+	pe.mu.RUnlock()
+
+	name := projectevNames[pe]
+	log.Finest("%s(%v, %s)", name, w, p)
+	for _, ev := range cbs {
+		pe.dispatch(name, mws, ev, w, p)
 	}
 }
 
@@ -198,6 +500,7 @@ var (
 		&OnPostSave:          "OnPostSave",
 		&OnModified:          "OnModified",
 		&OnSelectionModified: "OnSelectionModified",
+		&OnStatusChanged:     "OnStatusChanged",
 	}
 	wevNames = map[*WindowEvent]string{
 		&OnNewWindow:      "OnNewWindow",
@@ -215,33 +518,43 @@ var (
 
 func init() {
 	// Register functionality dealing with a couple of built in contexts
-	OnQueryContext.Add(func(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
-		if strings.HasPrefix(key, "setting.") && operator == util.OpEqual {
-			if v.Settings().Bool(key[8:]) {
+	OnQueryContext.RegisterPrefix("setting.", func(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+		if operator != util.OpEqual {
+			return Unknown
+		}
+		if v.Settings().Bool(key[len("setting."):]) {
+			return True
+		}
+		return False
+	})
+
+	OnQueryContext.RegisterTypedInt("num_selections", func(v *View, operator util.Op, operand int, match_all bool) QueryContextReturn {
+		switch operator {
+		case util.OpEqual:
+			if operand == v.Sel().Len() {
 				return True
 			}
 			return False
-		} else if key == "num_selections" {
-			opf, _ := operand.(float64)
-			op := int(opf)
-
-			switch operator {
-			case util.OpEqual:
-				if op == v.Sel().Len() {
-					return True
-				}
-				return False
-			case util.OpNotEqual:
-				if op != v.Sel().Len() {
-					return True
-				}
-				return False
+		case util.OpNotEqual:
+			if operand != v.Sel().Len() {
+				return True
 			}
+			return False
 		}
 		return Unknown
 	})
 
 	OnLoad.Add(func(v *View) {
-		GetEditor().Watch(v.FileName(), v)
+		GetEditor().WatchBounded(v.FileName(), v, maxWatchedFiles())
+	})
+
+	// A file evicted from the bounded watch by OnLoad starts being watched
+	// again as soon as the user activates it.
+	OnActivated.Add(func(v *View) {
+		GetEditor().WatchBounded(v.FileName(), v, maxWatchedFiles())
+	})
+
+	OnClose.Add(func(v *View) {
+		GetEditor().UnWatchBounded(v.FileName(), v)
 	})
 }
@@ -0,0 +1,254 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sort"
+
+	"github.com/limetext/backend/log"
+	"github.com/limetext/util"
+)
+
+type (
+	// ViewEventMiddleware wraps a single ViewEventCallback invocation.
+	// Implementations must call next to continue the chain; not calling it
+	// suppresses that callback.
+	ViewEventMiddleware func(next func(*View), v *View)
+
+	// WindowEventMiddleware wraps a single WindowEventCallback invocation.
+	WindowEventMiddleware func(next func(*Window), w *Window)
+
+	// PathEventMiddleware wraps a single PathEventCallback invocation.
+	PathEventMiddleware func(next func(string), p string)
+
+	// ProjectEventMiddleware wraps a single ProjectEventCallback invocation.
+	ProjectEventMiddleware func(next func(*Window, string), w *Window, p string)
+
+	// QueryContextMiddleware wraps a single QueryContextCallback invocation.
+	QueryContextMiddleware func(next func(*View, string, util.Op, interface{}, bool) QueryContextReturn,
+		v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn
+)
+
+// recoverAndLog calls fn, logging and swallowing any panic instead of
+// letting it unwind through the dispatch loop and take out every other
+// callback along with it. This is the recovery middleware every Event
+// carries by default, and it always runs innermost: middleware registered
+// via Use sees next return normally even when the wrapped callback panicked.
+func recoverAndLog(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("recovered panic in %s callback: %v", name, r)
+		}
+	}()
+	fn()
+}
+
+// Use registers mw around every future call to this ViewEvent's callbacks.
+// Middleware registered first runs outermost. Use does not check mw for nil;
+// the built-in panic recovery always runs innermost regardless of what's
+// registered here.
+func (ve *ViewEvent) Use(mw ViewEventMiddleware) {
+	ve.mu.Lock()
+	defer ve.mu.Unlock()
+	ve.middleware = append(ve.middleware, mw)
+}
+
+func (ve *ViewEvent) dispatch(name string, mws []ViewEventMiddleware, cb ViewEventCallback, v *View) {
+	next := func(v *View) { recoverAndLog(name, func() { cb(v) }) }
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, inner := mws[i], next
+		next = func(v *View) { mw(inner, v) }
+	}
+	next(v)
+}
+
+// dispatchAsync runs cb through the same recovery/middleware chain as a
+// synchronous callback, using whatever middleware is registered at the time
+// of the call rather than whatever was registered when AddAsync was called.
+func (ve *ViewEvent) dispatchAsync(name string, cb ViewEventCallback, v *View) {
+	ve.mu.RLock()
+	mws := make([]ViewEventMiddleware, len(ve.middleware))
+	copy(mws, ve.middleware)
+	ve.mu.RUnlock()
+	ve.dispatch(name, mws, cb, v)
+}
+
+// Use registers mw around every future call to this WindowEvent's callbacks.
+func (we *WindowEvent) Use(mw WindowEventMiddleware) {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	we.middleware = append(we.middleware, mw)
+}
+
+func (we *WindowEvent) dispatch(name string, mws []WindowEventMiddleware, cb WindowEventCallback, w *Window) {
+	next := func(w *Window) { recoverAndLog(name, func() { cb(w) }) }
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, inner := mws[i], next
+		next = func(w *Window) { mw(inner, w) }
+	}
+	next(w)
+}
+
+// Use registers mw around every future call to this PathEvent's callbacks.
+func (pe *PathEvent) Use(mw PathEventMiddleware) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.middleware = append(pe.middleware, mw)
+}
+
+func (pe *PathEvent) dispatch(name string, mws []PathEventMiddleware, cb PathEventCallback, p string) {
+	next := func(p string) { recoverAndLog(name, func() { cb(p) }) }
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, inner := mws[i], next
+		next = func(p string) { mw(inner, p) }
+	}
+	next(p)
+}
+
+// Use registers mw around every future call to this ProjectEvent's callbacks.
+func (pe *ProjectEvent) Use(mw ProjectEventMiddleware) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.middleware = append(pe.middleware, mw)
+}
+
+func (pe *ProjectEvent) dispatch(name string, mws []ProjectEventMiddleware, cb ProjectEventCallback, w *Window, p string) {
+	next := func(w *Window, p string) { recoverAndLog(name, func() { cb(w, p) }) }
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, inner := mws[i], next
+		next = func(w *Window, p string) { mw(inner, w, p) }
+	}
+	next(w, p)
+}
+
+// Use registers mw around every future call to OnQueryContext's callbacks
+// (including the exact-key and prefix registries, not just the ordered
+// list added via Add).
+func (qe *QueryContextEvent) Use(mw QueryContextMiddleware) {
+	qe.mu.Lock()
+	defer qe.mu.Unlock()
+	qe.middleware = append(qe.middleware, mw)
+}
+
+func (qe *QueryContextEvent) dispatch(name string, mws []QueryContextMiddleware, cb QueryContextCallback,
+	v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+	next := func(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+		r := Unknown
+		recoverAndLog(name, func() { r = cb(v, key, operator, operand, match_all) })
+		return r
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, inner := mws[i], next
+		next = func(v *View, key string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+			return mw(inner, v, key, operator, operand, match_all)
+		}
+	}
+	return next(v, key, operator, operand, match_all)
+}
+
+// events is the implementation behind the exported Events registry.
+type events struct{}
+
+// Events lets plugins introspect and instrument the package's built-in
+// Event types: list what exists, count listeners, and wrap dispatch with
+// cross-cutting concerns such as tracing, metrics, or gating.
+var Events events
+
+// ListViewEvents returns the names of the built-in ViewEvents (OnNew,
+// OnLoad, OnModified, ...), sorted alphabetically.
+func (events) ListViewEvents() []string {
+	names := make([]string, 0, len(evNames))
+	for _, n := range evNames {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListenerCount returns how many callbacks are currently registered against
+// the named event, counting both synchronous and (for ViewEvents) async
+// subscriptions. It returns 0 for an unknown name.
+func (events) ListenerCount(name string) int {
+	for ve, n := range evNames {
+		if n == name {
+			ve.mu.RLock()
+			defer ve.mu.RUnlock()
+			return len(ve.order) + len(ve.async)
+		}
+	}
+	for we, n := range wevNames {
+		if n == name {
+			we.mu.RLock()
+			defer we.mu.RUnlock()
+			return len(we.order)
+		}
+	}
+	for pe, n := range pkgPathevNames {
+		if n == name {
+			pe.mu.RLock()
+			defer pe.mu.RUnlock()
+			return len(pe.order)
+		}
+	}
+	for pe, n := range projectevNames {
+		if n == name {
+			pe.mu.RLock()
+			defer pe.mu.RUnlock()
+			return len(pe.order)
+		}
+	}
+	if name == "OnQueryContext" {
+		OnQueryContext.mu.RLock()
+		defer OnQueryContext.mu.RUnlock()
+		return len(OnQueryContext.order) + len(OnQueryContext.keyed) + len(OnQueryContext.prefixed)
+	}
+	return 0
+}
+
+// UseView registers mw on the named ViewEvent, e.g. Events.UseView("OnModified", mw).
+// It is a no-op if name doesn't identify a known ViewEvent.
+func (events) UseView(name string, mw ViewEventMiddleware) {
+	for ve, n := range evNames {
+		if n == name {
+			ve.Use(mw)
+			return
+		}
+	}
+}
+
+// UseWindow registers mw on the named WindowEvent.
+func (events) UseWindow(name string, mw WindowEventMiddleware) {
+	for we, n := range wevNames {
+		if n == name {
+			we.Use(mw)
+			return
+		}
+	}
+}
+
+// UsePath registers mw on the named PathEvent.
+func (events) UsePath(name string, mw PathEventMiddleware) {
+	for pe, n := range pkgPathevNames {
+		if n == name {
+			pe.Use(mw)
+			return
+		}
+	}
+}
+
+// UseProject registers mw on the named ProjectEvent.
+func (events) UseProject(name string, mw ProjectEventMiddleware) {
+	for pe, n := range projectevNames {
+		if n == name {
+			pe.Use(mw)
+			return
+		}
+	}
+}
+
+// UseQueryContext registers mw on OnQueryContext.
+func (events) UseQueryContext(mw QueryContextMiddleware) {
+	OnQueryContext.Use(mw)
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestSubscriptionCancelRemovesCallback checks the basic Add/Cancel contract
+// without any concurrency: once Cancel has returned, the callback no longer
+// runs.
+func TestSubscriptionCancelRemovesCallback(t *testing.T) {
+	var pe PathEvent
+	var calls int
+	sub := pe.Add(func(string) { calls++ })
+
+	pe.call("a")
+	sub.Cancel()
+	pe.call("b")
+
+	if calls != 1 {
+		t.Fatalf("expected 1 call before Cancel, got %d", calls)
+	}
+}
+
+// TestSubscriptionCancelIdempotent checks that Cancel can be called more
+// than once, and on a nil Subscription, without panicking.
+func TestSubscriptionCancelIdempotent(t *testing.T) {
+	var pe PathEvent
+	sub := pe.Add(func(string) {})
+	sub.Cancel()
+	sub.Cancel()
+
+	var nilSub *Subscription
+	nilSub.Cancel()
+}
+
+// TestPathEventAddCancelConcurrentWithCall exercises the RWMutex-guarded
+// registry added for Subscription support: one goroutine repeatedly calls
+// call() while another concurrently Adds and Cancels subscriptions. It's only
+// meaningful under -race, but it also fails outright (deadlock or panic) if
+// the copy-slice-then-iterate dispatch or the remove bookkeeping is wrong.
+func TestPathEventAddCancelConcurrentWithCall(t *testing.T) {
+	var pe PathEvent
+
+	const iterations = 500
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			pe.call("path")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			sub := pe.Add(func(string) {})
+			sub.Cancel()
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sort"
+
+	"github.com/limetext/backend/log"
+	"github.com/limetext/util"
+)
+
+// RegisterKey registers cb to handle exact matches of key. Call looks this
+// registry up before falling back to prefix handlers and the general,
+// registration-ordered callback list, so it is the fastest way to answer a
+// single well-known context such as "num_selections".
+//
+// Registering a second callback for the same key replaces the first.
+func (qe *QueryContextEvent) RegisterKey(key string, cb QueryContextCallback) {
+	qe.mu.Lock()
+	defer qe.mu.Unlock()
+	if qe.keyed == nil {
+		qe.keyed = make(map[string]QueryContextCallback)
+	}
+	qe.keyed[key] = cb
+}
+
+// RegisterPrefix registers cb to handle any key starting with prefix, e.g.
+// "setting." for the built-in setting.* contexts. When several registered
+// prefixes match a key, Call tries the longest prefix first.
+//
+// Registering a second callback for the same prefix replaces the first.
+func (qe *QueryContextEvent) RegisterPrefix(prefix string, cb QueryContextCallback) {
+	qe.mu.Lock()
+	defer qe.mu.Unlock()
+	if qe.prefixed == nil {
+		qe.prefixed = make(map[string]QueryContextCallback)
+	}
+	if _, ok := qe.prefixed[prefix]; !ok {
+		qe.prefixOrder = append(qe.prefixOrder, prefix)
+		sort.Slice(qe.prefixOrder, func(i, j int) bool {
+			return len(qe.prefixOrder[i]) > len(qe.prefixOrder[j])
+		})
+	}
+	qe.prefixed[prefix] = cb
+}
+
+// RegisterTypedBool registers a handler for key that only deals with bool
+// operands, doing the operand.(bool) assertion once instead of leaving it to
+// every plugin author to reimplement. If operand isn't a bool, the query is
+// logged and left Unknown rather than silently comparing against the zero
+// value.
+func (qe *QueryContextEvent) RegisterTypedBool(key string, fn func(v *View, op util.Op, operand bool, match_all bool) QueryContextReturn) {
+	qe.RegisterKey(key, func(v *View, k string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+		b, ok := operand.(bool)
+		if !ok {
+			log.Error("Context %s: expected a bool operand, got %v", key, operand)
+			return Unknown
+		}
+		return fn(v, operator, b, match_all)
+	})
+}
+
+// RegisterTypedInt registers a handler for key that only deals with int
+// operands. Context operands are decoded from JSON and therefore arrive as
+// float64; RegisterTypedInt does that conversion once.
+func (qe *QueryContextEvent) RegisterTypedInt(key string, fn func(v *View, op util.Op, operand int, match_all bool) QueryContextReturn) {
+	qe.RegisterKey(key, func(v *View, k string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+		f, ok := operand.(float64)
+		if !ok {
+			log.Error("Context %s: expected a numeric operand, got %v", key, operand)
+			return Unknown
+		}
+		return fn(v, operator, int(f), match_all)
+	})
+}
+
+// RegisterTypedString registers a handler for key that only deals with
+// string operands.
+func (qe *QueryContextEvent) RegisterTypedString(key string, fn func(v *View, op util.Op, operand string, match_all bool) QueryContextReturn) {
+	qe.RegisterKey(key, func(v *View, k string, operator util.Op, operand interface{}, match_all bool) QueryContextReturn {
+		s, ok := operand.(string)
+		if !ok {
+			log.Error("Context %s: expected a string operand, got %v", key, operand)
+			return Unknown
+		}
+		return fn(v, operator, s, match_all)
+	})
+}
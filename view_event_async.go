@@ -0,0 +1,241 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AsyncOpts configures a callback registered through ViewEvent.AddAsync.
+type AsyncOpts struct {
+	// Coalesce, when non-zero, collapses bursts of calls that arrive within
+	// the given window so only the most recent *View is delivered. This is
+	// the usual debounce needed for expensive work like reindexing on every
+	// keystroke.
+	Coalesce time.Duration
+
+	// Queue sets the size of the buffered channel feeding the worker
+	// goroutine. A Queue of 0 means unbuffered: Call blocks until the
+	// worker is ready to receive, Coalesce notwithstanding.
+	Queue int
+}
+
+// asyncMsg is what flows down an asyncSub's channel. A non-nil barrier
+// turns the message into a flush request instead of a View delivery; it is
+// sent through the same channel as real Views so FlushAsync only reports
+// done once everything queued ahead of it has actually been handled.
+type asyncMsg struct {
+	v       *View
+	barrier chan struct{}
+}
+
+// asyncSub is the per-subscription worker feeding a ViewEventCallback
+// asynchronously, off of ViewEvent.Call's goroutine. Delivery goes through
+// the owning ViewEvent's dispatch chain so an async callback gets the same
+// panic recovery and middleware as a synchronous one.
+type asyncSub struct {
+	owner *ViewEvent
+	name  string
+	cb    ViewEventCallback
+	opts  AsyncOpts
+	ch    chan asyncMsg
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAsyncSub(owner *ViewEvent, name string, cb ViewEventCallback, opts AsyncOpts) *asyncSub {
+	as := &asyncSub{
+		owner: owner,
+		name:  name,
+		cb:    cb,
+		opts:  opts,
+		ch:    make(chan asyncMsg, opts.Queue),
+	}
+	as.wg.Add(1)
+	go as.run()
+	return as
+}
+
+func (as *asyncSub) invoke(v *View) {
+	as.owner.dispatchAsync(as.name, as.cb, v)
+}
+
+func (as *asyncSub) run() {
+	defer as.wg.Done()
+	if as.opts.Coalesce <= 0 {
+		for msg := range as.ch {
+			if msg.barrier != nil {
+				close(msg.barrier)
+				continue
+			}
+			as.invoke(msg.v)
+		}
+		return
+	}
+	as.runCoalescing()
+}
+
+func (as *asyncSub) runCoalescing() {
+	var (
+		timer   *time.Timer
+		pending *View
+	)
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if pending != nil {
+			as.invoke(pending)
+			pending = nil
+		}
+	}
+	for {
+		var timerC <-chan time.Time
+		if timer != nil {
+			timerC = timer.C
+		}
+		select {
+		case msg, ok := <-as.ch:
+			if !ok {
+				flush()
+				return
+			}
+			if msg.barrier != nil {
+				flush()
+				close(msg.barrier)
+				continue
+			}
+			pending = msg.v
+			if timer == nil {
+				timer = time.NewTimer(as.opts.Coalesce)
+			} else {
+				timer.Reset(as.opts.Coalesce)
+			}
+		case <-timerC:
+			flush()
+		}
+	}
+}
+
+// deliver enqueues v for the worker goroutine. It is a no-op once close has
+// been called: closed is only ever set to true while holding mu, and the
+// channel is only ever closed after that, so deliver can never race a send
+// against a close of the same channel.
+func (as *asyncSub) deliver(v *View) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.closed {
+		return
+	}
+	as.ch <- asyncMsg{v: v}
+}
+
+// flush blocks until every message enqueued on as before this call has been
+// handled by the worker goroutine, or ctx is done. It's a no-op once close
+// has been called.
+func (as *asyncSub) flush(ctx context.Context) error {
+	barrier := make(chan struct{})
+
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		return nil
+	}
+	select {
+	case as.ch <- asyncMsg{barrier: barrier}:
+		as.mu.Unlock()
+	case <-ctx.Done():
+		as.mu.Unlock()
+		return ctx.Err()
+	}
+
+	select {
+	case <-barrier:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops the worker goroutine once it has drained anything already
+// queued for it. Safe to call concurrently with deliver/flush: once mu is
+// released with closed set, no further send on ch can happen, so closing it
+// here can't race a concurrent "send on closed channel" panic.
+func (as *asyncSub) close() {
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		return
+	}
+	as.closed = true
+	close(as.ch)
+	as.mu.Unlock()
+	as.wg.Wait()
+}
+
+// AddAsync registers cb to be invoked on its own goroutine, off the
+// dispatching path used by Call, so a slow listener (a linter, a symbol
+// indexer, ...) doesn't hold up the other callbacks registered via Add.
+// Call still blocks on a slow listener once its queue is full. See
+// AsyncOpts for coalescing bursts and bounding the backlog.
+//
+// Like a synchronous callback, cb runs through this ViewEvent's dispatch
+// chain: a panic in cb is recovered and logged rather than crashing the
+// worker goroutine (and the process with it), and any middleware
+// registered via Use still applies.
+//
+// The returned Subscription's Cancel stops the worker goroutine once it has
+// drained anything already queued for it, and is safe to call concurrently
+// with Call.
+func (ve *ViewEvent) AddAsync(cb ViewEventCallback, opts AsyncOpts) *Subscription {
+	ve.mu.Lock()
+	name := evNames[ve]
+	as := newAsyncSub(ve, name, cb, opts)
+	if ve.async == nil {
+		ve.async = make(map[uint64]*asyncSub)
+	}
+	ve.nextID++
+	id := ve.nextID
+	ve.async[id] = as
+	ve.mu.Unlock()
+
+	return &Subscription{id: id, remove: ve.removeAsync}
+}
+
+func (ve *ViewEvent) removeAsync(id uint64) {
+	ve.mu.Lock()
+	as, ok := ve.async[id]
+	if ok {
+		delete(ve.async, id)
+	}
+	ve.mu.Unlock()
+	if ok {
+		as.close()
+	}
+}
+
+// FlushAsync blocks until every AddAsync worker of this ViewEvent has
+// handled everything queued for it so far, or ctx is done. Tests and
+// shutdown paths should use this instead of racing the async workers.
+func (ve *ViewEvent) FlushAsync(ctx context.Context) error {
+	ve.mu.RLock()
+	subs := make([]*asyncSub, 0, len(ve.async))
+	for _, as := range ve.async {
+		subs = append(subs, as)
+	}
+	ve.mu.RUnlock()
+
+	for _, as := range subs {
+		if err := as.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestAsyncSub gives an asyncSub an owning ViewEvent to dispatch through
+// without requiring a real, registered ViewEvent.
+func newTestAsyncSub(cb ViewEventCallback, opts AsyncOpts) (*ViewEvent, *asyncSub) {
+	ve := &ViewEvent{}
+	as := newAsyncSub(ve, "TestEvent", cb, opts)
+	return ve, as
+}
+
+// TestAsyncSubDeliversInOrderWithoutCoalesce checks the plain (non-debounced)
+// path: every delivered View reaches cb, in order.
+func TestAsyncSubDeliversInOrderWithoutCoalesce(t *testing.T) {
+	var mu sync.Mutex
+	var got []*View
+
+	_, as := newTestAsyncSub(func(v *View) {
+		mu.Lock()
+		got = append(got, v)
+		mu.Unlock()
+	}, AsyncOpts{})
+	defer as.close()
+
+	views := []*View{{}, {}, {}}
+	for _, v := range views {
+		as.deliver(v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := as.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(views) {
+		t.Fatalf("expected %d callbacks, got %d", len(views), len(got))
+	}
+	for i, v := range views {
+		if got[i] != v {
+			t.Fatalf("callback %d: expected %p, got %p", i, v, got[i])
+		}
+	}
+}
+
+// TestAsyncSubCoalescesBursts checks that a burst of deliveries within the
+// Coalesce window collapses to a single callback invocation carrying the
+// most recent View, the debounce behavior AsyncOpts.Coalesce exists for.
+func TestAsyncSubCoalescesBursts(t *testing.T) {
+	var mu sync.Mutex
+	var got []*View
+
+	_, as := newTestAsyncSub(func(v *View) {
+		mu.Lock()
+		got = append(got, v)
+		mu.Unlock()
+	}, AsyncOpts{Coalesce: 50 * time.Millisecond})
+	defer as.close()
+
+	first, last := &View{}, &View{}
+	as.deliver(first)
+	as.deliver(&View{})
+	as.deliver(last)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := as.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("expected the burst to coalesce to 1 callback, got %d", len(got))
+	}
+	if got[0] != last {
+		t.Fatalf("expected the coalesced callback to carry the most recent View")
+	}
+}
+
+// TestAsyncSubCancelDoesNotPanicConcurrentDeliver guards the fix for
+// deliver racing Cancel: deliver must see the sub as closed and no-op
+// instead of sending on a channel close() is concurrently closing.
+func TestAsyncSubCancelDoesNotPanicConcurrentDeliver(t *testing.T) {
+	_, as := newTestAsyncSub(func(*View) {}, AsyncOpts{Queue: 1})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			as.deliver(&View{})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		as.close()
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,152 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultMaxWatchedFiles is the cap maxWatchedFiles returns when the
+// "max_watched_files" editor setting isn't set. It's chosen comfortably
+// below the inotify/kqueue per-process watch limits that otherwise fail
+// silently once exceeded.
+const defaultMaxWatchedFiles = 200
+
+// boundedWatcher tracks which paths are currently being watched and, once
+// more than max are active, which one was least recently touched so it can
+// be evicted to make room for a new one. Watch.Watcher allows more than one
+// callback per path (e.g. two views open on the same file), so the LRU is
+// kept over paths while a separate set tracks which views are registered
+// against each one.
+type boundedWatcher struct {
+	mu    sync.Mutex
+	order *list.List // most recently touched at the front
+	elems map[string]*list.Element
+	views map[string]map[*View]struct{}
+}
+
+func newBoundedWatcher() *boundedWatcher {
+	return &boundedWatcher{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+		views: make(map[string]map[*View]struct{}),
+	}
+}
+
+// touch records v as active for path, moving path to the front of the LRU.
+// needsWatch reports whether Watch(path, v) should be called because this
+// exact (path, v) pair wasn't already registered - two views opened on the
+// same path each need their own call. evicted lists paths pushed out by the
+// cap; the caller should fully stop watching each one, regardless of how
+// many views were registered against it. max can drop between calls (e.g.
+// the max_watched_files setting is lowered at runtime), so more than one
+// path may need to be evicted in a single call.
+func (bw *boundedWatcher) touch(path string, v *View, max int) (needsWatch bool, evicted []string) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	vs, ok := bw.views[path]
+	if !ok {
+		vs = make(map[*View]struct{})
+		bw.views[path] = vs
+	}
+	if _, ok := vs[v]; !ok {
+		vs[v] = struct{}{}
+		needsWatch = true
+	}
+
+	if el, ok := bw.elems[path]; ok {
+		bw.order.MoveToFront(el)
+		return needsWatch, nil
+	}
+	bw.elems[path] = bw.order.PushFront(path)
+
+	if max > 0 {
+		for bw.order.Len() > max {
+			back := bw.order.Back()
+			p := back.Value.(string)
+			bw.order.Remove(back)
+			delete(bw.elems, p)
+			delete(bw.views, p)
+			evicted = append(evicted, p)
+		}
+	}
+	return needsWatch, evicted
+}
+
+// forget drops v's registration for path, e.g. when the view it belongs to
+// is closed. allGone reports whether v was the last view registered against
+// path, in which case path is dropped from the LRU entirely and the caller
+// should stop watching it outright rather than just dropping v's callback.
+func (bw *boundedWatcher) forget(path string, v *View) (allGone bool) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	vs, ok := bw.views[path]
+	if ok {
+		delete(vs, v)
+		allGone = len(vs) == 0
+	} else {
+		allGone = true
+	}
+	if allGone {
+		delete(bw.views, path)
+		if el, ok := bw.elems[path]; ok {
+			bw.order.Remove(el)
+			delete(bw.elems, path)
+		}
+	}
+	return allGone
+}
+
+func (bw *boundedWatcher) len() int {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.order.Len()
+}
+
+var watched = newBoundedWatcher()
+
+// WatchBounded is like Watch, except it caps the number of simultaneously
+// watched paths at max, evicting the least recently active one to make room.
+// Call it from OnActivated as well as OnLoad so a file that was evicted
+// starts being watched again as soon as the user comes back to it, and from
+// every view that opens a path, since Watcher.Watch tracks callbacks per
+// view - a second view on an already-watched path still needs its own call.
+//
+// max is typically the "max_watched_files" editor setting; pass
+// defaultMaxWatchedFiles when it hasn't been configured.
+func (e *Editor) WatchBounded(path string, v *View, max int) {
+	needsWatch, evicted := watched.touch(path, v, max)
+	for _, p := range evicted {
+		e.UnWatch(p, nil)
+	}
+	if needsWatch {
+		e.Watch(path, v)
+	}
+}
+
+// UnWatchBounded releases v's watch on path, registered earlier via
+// WatchBounded. Other views still watching the same path are left alone.
+func (e *Editor) UnWatchBounded(path string, v *View) {
+	watched.forget(path, v)
+	e.UnWatch(path, v)
+}
+
+// WatchedFileCount reports how many paths WatchBounded currently considers
+// watched, for tests and the status bar.
+func (e *Editor) WatchedFileCount() int {
+	return watched.len()
+}
+
+// maxWatchedFiles reads the "max_watched_files" editor setting, falling
+// back to defaultMaxWatchedFiles when it isn't set.
+func maxWatchedFiles() int {
+	if n := GetEditor().Settings().Int("max_watched_files"); n > 0 {
+		return n
+	}
+	return defaultMaxWatchedFiles
+}
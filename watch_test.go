@@ -0,0 +1,126 @@
+// Copyright 2013 The lime Authors.
+// Use of this source code is governed by a 2-clause
+// BSD-style license that can be found in the LICENSE file.
+
+package backend
+
+import "testing"
+
+// TestBoundedWatcherEvictsLeastRecentlyTouched checks that pushing past max
+// evicts the least recently touched path, not an arbitrary one.
+func TestBoundedWatcherEvictsLeastRecentlyTouched(t *testing.T) {
+	bw := newBoundedWatcher()
+	a, b, c := &View{}, &View{}, &View{}
+
+	if needsWatch, evicted := bw.touch("a", a, 2); !needsWatch || len(evicted) != 0 {
+		t.Fatalf("touch a: needsWatch=%v evicted=%v", needsWatch, evicted)
+	}
+	if needsWatch, evicted := bw.touch("b", b, 2); !needsWatch || len(evicted) != 0 {
+		t.Fatalf("touch b: needsWatch=%v evicted=%v", needsWatch, evicted)
+	}
+
+	// Touching "a" again makes "b" the least recently touched.
+	if needsWatch, evicted := bw.touch("a", a, 2); needsWatch || len(evicted) != 0 {
+		t.Fatalf("re-touch a: needsWatch=%v evicted=%v", needsWatch, evicted)
+	}
+
+	needsWatch, evicted := bw.touch("c", c, 2)
+	if !needsWatch {
+		t.Fatalf("touch c: expected needsWatch")
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("touch c: expected [b] evicted, got %v", evicted)
+	}
+	if got := bw.len(); got != 2 {
+		t.Fatalf("expected 2 tracked paths, got %d", got)
+	}
+}
+
+// TestBoundedWatcherTouchEvictsMultipleWhenCapShrinks checks that a single
+// touch() call can evict more than one path when max has dropped below the
+// currently tracked count, not just the single most-recent overflow.
+func TestBoundedWatcherTouchEvictsMultipleWhenCapShrinks(t *testing.T) {
+	bw := newBoundedWatcher()
+	bw.touch("a", &View{}, 10)
+	bw.touch("b", &View{}, 10)
+	bw.touch("c", &View{}, 10)
+
+	needsWatch, evicted := bw.touch("d", &View{}, 1)
+	if !needsWatch {
+		t.Fatalf("touch d: expected needsWatch")
+	}
+	if len(evicted) != 3 {
+		t.Fatalf("expected 3 evictions when cap shrinks to 1, got %v", evicted)
+	}
+	if got := bw.len(); got != 1 {
+		t.Fatalf("expected 1 tracked path after shrinking the cap, got %d", got)
+	}
+}
+
+// TestBoundedWatcherForgetThenReTouchIsNew checks the re-watch path: once a
+// path is forgotten (e.g. its view closed), touching it again reports
+// needsWatch so the caller re-establishes the real watch.
+func TestBoundedWatcherForgetThenReTouchIsNew(t *testing.T) {
+	bw := newBoundedWatcher()
+	v := &View{}
+	bw.touch("a", v, 10)
+	if allGone := bw.forget("a", v); !allGone {
+		t.Fatalf("expected forgetting the only view to report allGone")
+	}
+
+	needsWatch, evicted := bw.touch("a", v, 10)
+	if !needsWatch {
+		t.Fatalf("expected re-touch after forget to report needsWatch")
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("expected no evictions, got %v", evicted)
+	}
+}
+
+// TestBoundedWatcherSecondViewOnSamePathNeedsItsOwnWatch guards against the
+// path-only keying regression: a second view opening an already-tracked
+// path must still be told to Watch, since Watcher.Watch tracks callbacks
+// per (path, cb) pair, not just per path.
+func TestBoundedWatcherSecondViewOnSamePathNeedsItsOwnWatch(t *testing.T) {
+	bw := newBoundedWatcher()
+	v1, v2 := &View{}, &View{}
+
+	if needsWatch, _ := bw.touch("a", v1, 10); !needsWatch {
+		t.Fatalf("first view on a: expected needsWatch")
+	}
+	if needsWatch, _ := bw.touch("a", v2, 10); !needsWatch {
+		t.Fatalf("second view on a: expected needsWatch, got false")
+	}
+	// Touching v1 again on the same path is still a no-op.
+	if needsWatch, _ := bw.touch("a", v1, 10); needsWatch {
+		t.Fatalf("re-touch of v1 on a: expected needsWatch=false")
+	}
+	if got := bw.len(); got != 1 {
+		t.Fatalf("expected 1 tracked path shared by two views, got %d", got)
+	}
+}
+
+// TestBoundedWatcherForgetLeavesOtherViewsWatched guards against closing one
+// view tearing down the watch for every other view still open on the same
+// path: forgetting one of two views must report allGone=false and leave the
+// path tracked.
+func TestBoundedWatcherForgetLeavesOtherViewsWatched(t *testing.T) {
+	bw := newBoundedWatcher()
+	v1, v2 := &View{}, &View{}
+	bw.touch("a", v1, 10)
+	bw.touch("a", v2, 10)
+
+	if allGone := bw.forget("a", v1); allGone {
+		t.Fatalf("expected forgetting v1 to report allGone=false while v2 remains")
+	}
+	if got := bw.len(); got != 1 {
+		t.Fatalf("expected a to remain tracked while v2 is still watching it, got %d tracked", got)
+	}
+
+	if allGone := bw.forget("a", v2); !allGone {
+		t.Fatalf("expected forgetting the last view to report allGone=true")
+	}
+	if got := bw.len(); got != 0 {
+		t.Fatalf("expected a to be dropped once its last view is forgotten, got %d tracked", got)
+	}
+}